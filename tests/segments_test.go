@@ -0,0 +1,667 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/Vilsol/go-mlog/transpiler"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const fooSegment = transpiler.FunctionSegmentPrefix + "foo"
+
+// mainPrinted is what one pass of the segments test program prints
+const mainPrinted = "20\n21\n22\n23\n24\n25\n26\n27\n28\n29\n"
+
+func TestSegments(t *testing.T) {
+	const testInput = `package main
+
+func main() {
+	for i := 0; i < 10; i++ {
+		println(foo(i))
+	}
+}
+
+func foo(x int) int {
+	return x + 20
+}`
+
+	fragment := func() map[string][]transpiler.MLOGStatement {
+		return map[string][]transpiler.MLOGStatement{
+			"draw": {
+				&transpiler.MLOG{
+					Comment: "Hand-written fragment",
+					Statement: [][]transpiler.Resolvable{
+						{
+							&transpiler.Value{Value: "print"},
+							&transpiler.Value{Value: `"fragment"`},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	value := func(value string) *transpiler.Value {
+		return &transpiler.Value{Value: value}
+	}
+
+	// Loops with a fragment relative jump, then calls foo and continues in main
+	callingFragment := func() map[string][]transpiler.MLOGStatement {
+		return map[string][]transpiler.MLOGStatement{
+			"draw": {
+				&transpiler.MLOG{Statement: [][]transpiler.Resolvable{{value("set"), value("frag_i"), value("0")}}},
+				&transpiler.MLOG{Statement: [][]transpiler.Resolvable{{value("op"), value("add"), value("frag_i"), value("frag_i"), value("1")}}},
+				&transpiler.MLOG{Statement: [][]transpiler.Resolvable{{value("jump"), value("1"), value("lessThan"), value("frag_i"), value("10")}}},
+				&transpiler.MLOG{Statement: [][]transpiler.Resolvable{{value("set"), value("@funcArg_foo_0"), value("frag_i")}}},
+				&transpiler.MLOGTrampoline{
+					Extra:    2,
+					Function: "foo",
+				},
+				&transpiler.MLOGJump{
+					Condition:  []transpiler.Resolvable{value("always")},
+					JumpTarget: &transpiler.FunctionJumpTarget{FunctionName: "foo"},
+				},
+				&transpiler.MLOG{Statement: [][]transpiler.Resolvable{{value("print"), value("@return_0")}}},
+				&transpiler.MLOGJump{
+					Condition:  []transpiler.Resolvable{value("always")},
+					JumpTarget: &transpiler.FunctionJumpTarget{FunctionName: "main"},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		order   []string
+		extra   map[string][]transpiler.MLOGStatement
+		options transpiler.Options
+		output  string
+		printed string
+		err     string
+	}{
+		{
+			name:  "DefaultOrder",
+			order: []string{transpiler.PreambleSegment, fooSegment, transpiler.MainSegment},
+			output: `jump 5 always
+set _foo_x @funcArg_foo_0
+op add _foo_0 _foo_x 20
+set @return_0 _foo_0
+set @counter @funcTramp_foo
+set _main_i 0
+jump 8 lessThan _main_i 10
+jump 16 always
+set @funcArg_foo_0 _main_i
+set @funcTramp_foo 11
+jump 1 always
+set _main_0 @return_0
+print _main_0
+print "\n"
+op add _main_i _main_i 1
+jump 8 lessThan _main_i 10`,
+		},
+		{
+			name:  "ReorderWithFragment",
+			order: []string{transpiler.PreambleSegment, transpiler.MainSegment, "draw", fooSegment},
+			extra: fragment(),
+			output: `jump 1 always
+set _main_i 0
+jump 4 lessThan _main_i 10
+jump 12 always
+set @funcArg_foo_0 _main_i
+set @funcTramp_foo 7
+jump 14 always
+set _main_0 @return_0
+print _main_0
+print "\n"
+op add _main_i _main_i 1
+jump 4 lessThan _main_i 10
+end
+print "fragment"
+set _foo_x @funcArg_foo_0
+op add _foo_0 _foo_x 20
+set @return_0 _foo_0
+set @counter @funcTramp_foo`,
+		},
+		{
+			name:  "FragmentBeforeMain",
+			order: []string{transpiler.PreambleSegment, "draw", fooSegment, transpiler.MainSegment},
+			extra: fragment(),
+			output: `jump 6 always
+print "fragment"
+set _foo_x @funcArg_foo_0
+op add _foo_0 _foo_x 20
+set @return_0 _foo_0
+set @counter @funcTramp_foo
+set _main_i 0
+jump 9 lessThan _main_i 10
+jump 17 always
+set @funcArg_foo_0 _main_i
+set @funcTramp_foo 12
+jump 2 always
+set _main_0 @return_0
+print _main_0
+print "\n"
+op add _main_i _main_i 1
+jump 9 lessThan _main_i 10`,
+		},
+		{
+			name:    "ReorderStacked",
+			order:   []string{transpiler.PreambleSegment, transpiler.MainSegment, fooSegment},
+			options: transpiler.Options{Stacked: "cell1"},
+			output: `set @stack 0
+jump 2 always
+set _main_i 0
+jump 5 lessThan _main_i 10
+jump 16 always
+op add @stack @stack 1
+write _main_i cell1 @stack
+op add @stack @stack 1
+write 10 cell1 @stack
+jump 17 always
+op sub @stack @stack 2
+set _main_0 @return_0
+print _main_0
+print "\n"
+op add _main_i _main_i 1
+jump 5 lessThan _main_i 10
+end
+op sub _foo_0 @stack 1
+read _foo_x cell1 _foo_0
+op add _foo_1 _foo_x 20
+set @return_0 _foo_1
+read @counter cell1 @stack`,
+		},
+		{
+			name:    "ReachableFragment",
+			order:   []string{"draw", transpiler.MainSegment, fooSegment},
+			extra:   callingFragment(),
+			options: transpiler.Options{NoStartup: true},
+			printed: "30" + mainPrinted,
+			output: `set frag_i 0
+op add frag_i frag_i 1
+jump 1 lessThan frag_i 10
+set @funcArg_foo_0 frag_i
+set @funcTramp_foo 6
+jump 20 always
+print @return_0
+jump 8 always
+set _main_i 0
+jump 11 lessThan _main_i 10
+jump 19 always
+set @funcArg_foo_0 _main_i
+set @funcTramp_foo 14
+jump 20 always
+set _main_0 @return_0
+print _main_0
+print "\n"
+op add _main_i _main_i 1
+jump 11 lessThan _main_i 10
+end
+set _foo_x @funcArg_foo_0
+op add _foo_0 _foo_x 20
+set @return_0 _foo_0
+set @counter @funcTramp_foo`,
+		},
+		{
+			name:  "RelocatedFragment",
+			order: []string{transpiler.PreambleSegment, fooSegment, "draw", transpiler.MainSegment},
+			extra: callingFragment(),
+			output: `jump 13 always
+set _foo_x @funcArg_foo_0
+op add _foo_0 _foo_x 20
+set @return_0 _foo_0
+set @counter @funcTramp_foo
+set frag_i 0
+op add frag_i frag_i 1
+jump 6 lessThan frag_i 10
+set @funcArg_foo_0 frag_i
+set @funcTramp_foo 11
+jump 1 always
+print @return_0
+jump 13 always
+set _main_i 0
+jump 16 lessThan _main_i 10
+jump 24 always
+set @funcArg_foo_0 _main_i
+set @funcTramp_foo 19
+jump 1 always
+set _main_0 @return_0
+print _main_0
+print "\n"
+op add _main_i _main_i 1
+jump 16 lessThan _main_i 10`,
+		},
+		{
+			name:  "MultiLineFragment",
+			order: []string{transpiler.PreambleSegment, "draw", transpiler.MainSegment, fooSegment},
+			extra: map[string][]transpiler.MLOGStatement{
+				"draw": {
+					&transpiler.MLOG{
+						Statement: [][]transpiler.Resolvable{
+							{value("print"), value("1")},
+							{value("jump"), value("0"), value("always")},
+						},
+					},
+				},
+			},
+			output: `jump 3 always
+print 1
+jump 1 always
+set _main_i 0
+jump 6 lessThan _main_i 10
+jump 14 always
+set @funcArg_foo_0 _main_i
+set @funcTramp_foo 9
+jump 15 always
+set _main_0 @return_0
+print _main_0
+print "\n"
+op add _main_i _main_i 1
+jump 6 lessThan _main_i 10
+end
+set _foo_x @funcArg_foo_0
+op add _foo_0 _foo_x 20
+set @return_0 _foo_0
+set @counter @funcTramp_foo`,
+		},
+		{
+			name:  "ReachableMultiLineFragment",
+			order: []string{"draw", transpiler.MainSegment, fooSegment},
+			extra: map[string][]transpiler.MLOGStatement{
+				"draw": {
+					&transpiler.MLOG{
+						Statement: [][]transpiler.Resolvable{
+							{value("set"), value("frag_i"), value("0")},
+							{value("op"), value("add"), value("frag_i"), value("frag_i"), value("1")},
+							{value("jump"), value("1"), value("lessThan"), value("frag_i"), value("3")},
+							{value("print"), value("frag_i")},
+						},
+					},
+				},
+			},
+			options: transpiler.Options{NoStartup: true},
+			printed: "3" + mainPrinted,
+			output: `set frag_i 0
+op add frag_i frag_i 1
+jump 1 lessThan frag_i 3
+print frag_i
+set _main_i 0
+jump 7 lessThan _main_i 10
+jump 15 always
+set @funcArg_foo_0 _main_i
+set @funcTramp_foo 10
+jump 16 always
+set _main_0 @return_0
+print _main_0
+print "\n"
+op add _main_i _main_i 1
+jump 7 lessThan _main_i 10
+end
+set _foo_x @funcArg_foo_0
+op add _foo_0 _foo_x 20
+set @return_0 _foo_0
+set @counter @funcTramp_foo`,
+		},
+		{
+			name:    "NoStartupWithoutPreamble",
+			order:   []string{transpiler.MainSegment, fooSegment},
+			options: transpiler.Options{NoStartup: true},
+			output: `set _main_i 0
+jump 3 lessThan _main_i 10
+jump 11 always
+set @funcArg_foo_0 _main_i
+set @funcTramp_foo 6
+jump 12 always
+set _main_0 @return_0
+print _main_0
+print "\n"
+op add _main_i _main_i 1
+jump 3 lessThan _main_i 10
+end
+set _foo_x @funcArg_foo_0
+op add _foo_0 _foo_x 20
+set @return_0 _foo_0
+set @counter @funcTramp_foo`,
+		},
+		{
+			name:  "MissingSegment",
+			order: []string{transpiler.PreambleSegment, transpiler.MainSegment},
+			err:   "missing segment: func:foo",
+		},
+		{
+			name:  "DuplicateSegment",
+			order: []string{transpiler.PreambleSegment, fooSegment, fooSegment, transpiler.MainSegment},
+			err:   "segment used more than once: func:foo",
+		},
+		{
+			name:  "UnknownSegment",
+			order: []string{transpiler.PreambleSegment, "bar", fooSegment, transpiler.MainSegment},
+			err:   "unknown segment: bar",
+		},
+		{
+			name:  "UnusedFragment",
+			order: []string{transpiler.PreambleSegment, fooSegment, transpiler.MainSegment},
+			extra: fragment(),
+			err:   "unused fragment: draw",
+		},
+		{
+			name:  "FragmentNameConflict",
+			order: []string{transpiler.PreambleSegment, fooSegment, transpiler.MainSegment},
+			extra: map[string][]transpiler.MLOGStatement{
+				fooSegment: fragment()["draw"],
+			},
+			err: "reserved fragment name: func:foo",
+		},
+		{
+			name:    "ReservedPreambleWithoutStartup",
+			order:   []string{transpiler.PreambleSegment, fooSegment, transpiler.MainSegment},
+			options: transpiler.Options{NoStartup: true},
+			extra: map[string][]transpiler.MLOGStatement{
+				transpiler.PreambleSegment: fragment()["draw"],
+			},
+			err: "reserved fragment name: Preamble",
+		},
+		{
+			name:    "FunctionFirstWithoutStartup",
+			order:   []string{fooSegment, transpiler.MainSegment},
+			options: transpiler.Options{NoStartup: true},
+			err:     "function may not be the first segment: func:foo",
+		},
+		{
+			name:  "FragmentJumpToEnd",
+			order: []string{transpiler.PreambleSegment, fooSegment, "draw", transpiler.MainSegment},
+			extra: map[string][]transpiler.MLOGStatement{
+				"draw": {
+					&transpiler.MLOG{Statement: [][]transpiler.Resolvable{{value("jump"), value("1"), value("always")}}},
+				},
+			},
+			err: "invalid jump target in segment draw: 6",
+		},
+		{
+			name:  "FragmentWritesCounter",
+			order: []string{transpiler.PreambleSegment, fooSegment, "draw", transpiler.MainSegment},
+			extra: map[string][]transpiler.MLOGStatement{
+				"draw": {
+					&transpiler.MLOG{Statement: [][]transpiler.Resolvable{{value("set"), value("@counter"), value("0")}}},
+				},
+			},
+			err: "fragment writes @counter directly in segment: draw",
+		},
+		{
+			name:  "PreambleNotFirst",
+			order: []string{fooSegment, transpiler.PreambleSegment, transpiler.MainSegment},
+			err:   "preamble must be the first segment",
+		},
+		{
+			name:  "FragmentJumpOutOfFragment",
+			order: []string{transpiler.PreambleSegment, fooSegment, "draw", transpiler.MainSegment},
+			extra: map[string][]transpiler.MLOGStatement{
+				"draw": {
+					&transpiler.MLOG{Statement: [][]transpiler.Resolvable{{value("jump"), value("2"), value("always")}}},
+				},
+			},
+			err: "invalid jump target in segment draw: 7",
+		},
+		{
+			name:  "InvalidJumpTarget",
+			order: []string{transpiler.PreambleSegment, fooSegment, transpiler.MainSegment, "draw"},
+			extra: map[string][]transpiler.MLOGStatement{
+				"draw": {
+					&transpiler.MLOG{
+						Statement: [][]transpiler.Resolvable{
+							{
+								&transpiler.Value{Value: "jump"},
+								&transpiler.Value{Value: "100"},
+								&transpiler.Value{Value: "always"},
+							},
+						},
+					},
+				},
+			},
+			err: "invalid jump target in segment draw: 117",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			program, err := transpiler.GolangToMLOGProgram(testInput, test.options)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			mlog, err := program.AssembleSegments(test.order, test.extra)
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			test.output = test.output + "\n"
+			assert.Equal(t, test.output, mlog)
+
+			if test.printed == "" {
+				test.printed = mainPrinted
+			}
+			assert.Equal(t, test.printed, traceMLOG(t, mlog))
+		})
+	}
+}
+
+func TestSegmentRanges(t *testing.T) {
+	program, err := transpiler.GolangToMLOGProgram(`package main
+
+func main() {
+	println(foo(1))
+}
+
+func foo(x int) int {
+	return x + 20
+}`, transpiler.Options{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	names := make([]string, 0)
+	for _, segment := range program.Segments {
+		names = append(names, segment.Name)
+	}
+	assert.Equal(t, "Preamble,func:foo,Main", strings.Join(names, ","))
+
+	assert.Equal(t, 0, program.Segments[0].Start)
+	assert.Equal(t, 1, program.Segments[0].End)
+	assert.Equal(t, 1, program.Segments[1].Start)
+	assert.Equal(t, 5, program.Segments[1].End)
+	assert.Equal(t, 5, program.Segments[2].Start)
+	assert.Equal(t, 11, program.Segments[2].End)
+
+	rendered := program.Render()
+
+	_, err = program.AssembleSegments([]string{transpiler.PreambleSegment, transpiler.MainSegment, fooSegment}, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assembled := make([]string, 0)
+	for _, segment := range program.Assembled {
+		assembled = append(assembled, fmt.Sprintf("%s:%d-%d", segment.Name, segment.Start, segment.End))
+	}
+	assert.Equal(t, "Preamble:0-1,Main:1-8,func:foo:8-12", strings.Join(assembled, ","))
+
+	original := make([]string, 0)
+	for _, segment := range program.Segments {
+		original = append(original, fmt.Sprintf("%s:%d-%d", segment.Name, segment.Start, segment.End))
+	}
+	assert.Equal(t, "Preamble:0-1,func:foo:1-5,Main:5-11", strings.Join(original, ","))
+
+	assert.Equal(t, rendered, program.Render())
+}
+
+func TestSegmentReservedNames(t *testing.T) {
+	program, err := transpiler.GolangToMLOGProgram(`package main
+
+func main() {
+	println(Main(1))
+	println(Preamble(2))
+}
+
+func Main(x int) int {
+	return x + 20
+}
+
+func Preamble(x int) int {
+	return x + 30
+}`, transpiler.Options{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = program.AssembleSegments([]string{
+		transpiler.PreambleSegment,
+		transpiler.MainSegment,
+		transpiler.FunctionSegmentPrefix + "Preamble",
+		transpiler.FunctionSegmentPrefix + "Main",
+	}, nil)
+	assert.NoError(t, err)
+}
+
+func TestSegmentFragmentCallsUnusedFunction(t *testing.T) {
+	program, err := transpiler.GolangToMLOGProgram(`package main
+
+func main() {
+	println(1)
+}
+
+func bar() {
+	println(2)
+}`, transpiler.Options{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = program.AssembleSegments([]string{transpiler.PreambleSegment, transpiler.MainSegment, "draw"}, map[string][]transpiler.MLOGStatement{
+		"draw": {
+			&transpiler.MLOGJump{
+				Condition:  []transpiler.Resolvable{&transpiler.Value{Value: "always"}},
+				JumpTarget: &transpiler.FunctionJumpTarget{FunctionName: "bar"},
+			},
+		},
+	})
+	assert.EqualError(t, err, "fragment calls function that is not part of the program: bar")
+
+	_, err = program.AssembleSegments([]string{transpiler.PreambleSegment, transpiler.MainSegment}, nil)
+	assert.NoError(t, err)
+}
+
+func TestSegmentsDefaultBehaviour(t *testing.T) {
+	for _, options := range []transpiler.Options{{}, {Stacked: "cell1"}} {
+		mlog, err := transpiler.GolangToMLOG(`package main
+
+func main() {
+	for i := 0; i < 10; i++ {
+		println(foo(i))
+	}
+}
+
+func foo(x int) int {
+	return x + 20
+}`, options)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		assert.Equal(t, mainPrinted, traceMLOG(t, mlog))
+	}
+}
+
+// traceMLOG executes the subset of MLOG used by the segment tests until the program
+// ends or wraps around, and returns everything it printed.
+// There is no MLOG emulator in this repository, so this stands in for one when comparing
+// the behaviour of reassembled programs with the default layout.
+func traceMLOG(t *testing.T, program string) string {
+	lines := make([][]string, 0)
+	for _, line := range strings.Split(strings.TrimSpace(program), "\n") {
+		lines = append(lines, strings.Fields(line))
+	}
+
+	variables := make(map[string]float64)
+	memory := make(map[string]map[float64]float64)
+	resolve := func(token string) float64 {
+		if value, err := strconv.ParseFloat(token, 64); err == nil {
+			return value
+		}
+		return variables[token]
+	}
+
+	output := &strings.Builder{}
+	counter := 0
+	for steps := 0; counter < len(lines); steps++ {
+		if steps > 10000 {
+			t.Error("program did not terminate")
+			break
+		}
+
+		line := lines[counter]
+		counter++
+
+		switch line[0] {
+		case "set":
+			variables[line[1]] = resolve(line[2])
+		case "op":
+			switch line[1] {
+			case "add":
+				variables[line[2]] = resolve(line[3]) + resolve(line[4])
+			case "sub":
+				variables[line[2]] = resolve(line[3]) - resolve(line[4])
+			default:
+				t.Errorf("unsupported operation: %s", line[1])
+				return output.String()
+			}
+		case "jump":
+			condition := line[2] == "always"
+			if line[2] == "lessThan" {
+				condition = resolve(line[3]) < resolve(line[4])
+			}
+			if condition {
+				counter = int(resolve(line[1]))
+			}
+		case "print":
+			if line[1] == `"\n"` {
+				output.WriteString("\n")
+			} else if strings.HasPrefix(line[1], `"`) {
+				output.WriteString(strings.Trim(line[1], `"`))
+			} else {
+				output.WriteString(strconv.FormatFloat(resolve(line[1]), 'f', -1, 64))
+			}
+		case "write":
+			if memory[line[2]] == nil {
+				memory[line[2]] = make(map[float64]float64)
+			}
+			memory[line[2]][resolve(line[3])] = resolve(line[1])
+		case "read":
+			variables[line[1]] = memory[line[2]][resolve(line[3])]
+		case "end":
+			return output.String()
+		default:
+			t.Errorf("unsupported instruction: %s", line[0])
+			return output.String()
+		}
+
+		if value, ok := variables["@counter"]; ok {
+			counter = int(value)
+			delete(variables, "@counter")
+		}
+	}
+
+	return output.String()
+}
@@ -3,13 +3,11 @@ package transpiler
 import (
 	"context"
 	"fmt"
-	"github.com/olekukonko/tablewriter"
 	"go/ast"
 	"go/parser"
 	"go/token"
 	"io/ioutil"
 	"strconv"
-	"strings"
 )
 
 const stackVariable = `@stack`
@@ -35,22 +33,33 @@ func GolangToMLOGBytes(input []byte, options Options) (string, error) {
 }
 
 func GolangToMLOG(input string, options Options) (string, error) {
+	program, err := GolangToMLOGProgram(input, options)
+	if err != nil {
+		return "", err
+	}
+
+	return program.Render(), nil
+}
+
+// GolangToMLOGProgram transpiles the input and returns the program split into segments,
+// which can then be rendered in the default layout or reassembled in a custom order.
+func GolangToMLOGProgram(input string, options Options) (*Program, error) {
 	ctx := context.WithValue(context.Background(), contextOptions, options)
 
 	fileSet := token.NewFileSet()
 	f, err := parser.ParseFile(fileSet, "foo", input, 0)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if f.Name.Name != "main" {
-		return "", Err(ctx, "package must be main")
+		return nil, Err(ctx, "package must be main")
 	}
 
 	for _, imp := range f.Imports {
 		if _, ok := validImports[imp.Path.Value]; !ok {
-			return "", Err(context.WithValue(ctx, contextSpec, imp), "unregistered import used: "+imp.Path.Value)
+			return nil, Err(context.WithValue(ctx, contextSpec, imp), "unregistered import used: "+imp.Path.Value)
 		}
 	}
 
@@ -65,18 +74,18 @@ func GolangToMLOG(input string, options Options) (string, error) {
 			break
 		case *ast.GenDecl:
 			if castDecl.Tok.String() == "var" {
-				return "", Err(context.WithValue(ctx, contextDecl, decl), "global scope may only contain constants not variables")
+				return nil, Err(context.WithValue(ctx, contextDecl, decl), "global scope may only contain constants not variables")
 			} else if castDecl.Tok.String() == "const" {
 				constants = append(constants, castDecl)
 			}
 			break
 		case *ast.BadDecl:
-			return "", Err(ctx, "syntax error in input file")
+			return nil, Err(ctx, "syntax error in input file")
 		}
 	}
 
 	if mainFunc == nil {
-		return "", Err(ctx, "file does not contain a main function")
+		return nil, Err(ctx, "file does not contain a main function")
 	}
 
 	global := &Global{
@@ -94,7 +103,7 @@ func GolangToMLOG(input string, options Options) (string, error) {
 			fnCtx := context.WithValue(ctx, contextFunction, castDecl)
 			statements, err := statementToMLOG(fnCtx, castDecl.Body)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
 
 			if len(statements) == 0 {
@@ -106,15 +115,15 @@ func GolangToMLOG(input string, options Options) (string, error) {
 				if paramTypeIdent, ok := param.Type.(*ast.Ident); ok {
 					if options.Stacked != "" {
 						if paramTypeIdent.Name != "int" && paramTypeIdent.Name != "float64" {
-							return "", Err(fnCtx, "function parameters may only be integers or floating point numbers in stack mode")
+							return nil, Err(fnCtx, "function parameters may only be integers or floating point numbers in stack mode")
 						}
 					} else {
 						if paramTypeIdent.Name != "int" && paramTypeIdent.Name != "float64" && paramTypeIdent.Name != "string" {
-							return "", Err(fnCtx, "function parameters may only be integers, floating point numbers or strings")
+							return nil, Err(fnCtx, "function parameters may only be integers, floating point numbers or strings")
 						}
 					}
 				} else {
-					return "", Err(fnCtx, "function parameters may only be basic types")
+					return nil, Err(fnCtx, "function parameters may only be basic types")
 				}
 
 				position := len(castDecl.Type.Params.List) - i
@@ -189,11 +198,11 @@ func GolangToMLOG(input string, options Options) (string, error) {
 	mainStatements, err := statementToMLOG(context.WithValue(ctx, contextFunction, mainFunc), mainFunc.Body)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(mainStatements) == 0 {
-		return "", Err(ctx, "empty main function")
+		return nil, Err(ctx, "empty main function")
 	}
 
 	global.Functions = append(global.Functions, &Function{
@@ -234,7 +243,7 @@ func GolangToMLOG(input string, options Options) (string, error) {
 					value = valueType.Name
 					break
 				default:
-					return "", Err(context.WithValue(ctx, contextSpec, spec), fmt.Sprintf("unknown constant type: %T", valueSpec.Values[i]))
+					return nil, Err(context.WithValue(ctx, contextSpec, spec), fmt.Sprintf("unknown constant type: %T", valueSpec.Values[i]))
 				}
 
 				startup = append(startup, &MLOG{
@@ -275,76 +284,31 @@ func GolangToMLOG(input string, options Options) (string, error) {
 
 	for _, statement := range startup {
 		if err := statement.PreProcess(context.WithValue(ctx, contextFunction, mainFunc), global, nil); err != nil {
-			return "", err
+			return nil, err
 		}
 	}
 
 	for _, fn := range global.Functions {
 		for _, statement := range fn.Statements {
 			if err := statement.PreProcess(context.WithValue(ctx, contextFunction, fn.Declaration), global, fn); err != nil {
-				return "", err
+				return nil, err
 			}
 		}
 	}
 
-	position := len(startup)
-	for _, fn := range global.Functions {
-		if !fn.Called {
-			continue
-		}
-
-		for _, statement := range fn.Statements {
-			position += statement.SetPosition(position)
-		}
-	}
-
-	for _, statement := range startup {
-		if err := statement.PostProcess(context.WithValue(ctx, contextFunction, mainFunc), global, nil); err != nil {
-			return "", err
-		}
+	program := &Program{
+		Segments: make([]*Segment, 0),
+		ctx:      ctx,
+		global:   global,
+		input:    input,
 	}
 
-	for _, fn := range global.Functions {
-		if !fn.Called {
-			continue
-		}
-
-		for _, statement := range fn.Statements {
-			if err := statement.PostProcess(context.WithValue(ctx, contextFunction, fn.Declaration), global, fn); err != nil {
-				return "", err
-			}
-		}
-	}
-
-	var tableString *strings.Builder
-	var table *tablewriter.Table
-	if options.Comments || options.Numbers || options.Source {
-		tableString = &strings.Builder{}
-		table = tablewriter.NewWriter(tableString)
-		table.SetBorder(false)
-		table.SetAutoWrapText(false)
-		table.SetCenterSeparator("#")
-		table.SetColumnSeparator("#")
-		table.SetHeaderLine(false)
-		table.SetAlignment(tablewriter.ALIGN_LEFT)
-		table.SetNoWhiteSpace(true)
-		table.SetTablePadding("\t")
-	}
-
-	outputData := ""
-
-	lineNumber := 0
-	for _, statement := range startup {
-		statements := statement.ToMLOG()
-		mlogLines := MLOGToString(context.WithValue(ctx, contextFunction, mainFunc), statements, statement, lineNumber, input)
-		if table != nil {
-			table.AppendBulk(mlogLines)
-		} else {
-			for _, line := range mlogLines {
-				outputData += line[0] + "\n"
-			}
-		}
-		lineNumber += len(statements)
+	if len(startup) > 0 {
+		program.Segments = append(program.Segments, &Segment{
+			Name:        PreambleSegment,
+			Statements:  startup,
+			Declaration: mainFunc,
+		})
 	}
 
 	for _, fn := range global.Functions {
@@ -352,30 +316,22 @@ func GolangToMLOG(input string, options Options) (string, error) {
 			continue
 		}
 
-		if options.Comments && table != nil {
-			table.Append([]string{"#"})
-			table.Append([]string{"# Function: " + fn.Name + " #"})
-			table.Append([]string{"#"})
+		name := FunctionSegmentPrefix + fn.Name
+		if fn.Name == mainFuncName {
+			name = MainSegment
 		}
 
-		for _, statement := range fn.Statements {
-			statements := statement.ToMLOG()
-			mlogLines := MLOGToString(context.WithValue(ctx, contextFunction, fn.Declaration), statements, statement, lineNumber, input)
-			if table != nil {
-				table.AppendBulk(mlogLines)
-			} else {
-				for _, line := range mlogLines {
-					outputData += line[0] + "\n"
-				}
-			}
-			lineNumber += len(statements)
-		}
+		program.Segments = append(program.Segments, &Segment{
+			Name:        name,
+			Statements:  fn.Statements,
+			Function:    fn,
+			Declaration: fn.Declaration,
+		})
 	}
 
-	if table != nil && tableString != nil {
-		table.Render()
-		return tableString.String(), nil
+	if err := program.layout(program.Segments); err != nil {
+		return nil, err
 	}
 
-	return outputData, nil
+	return program, nil
 }
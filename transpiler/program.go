@@ -0,0 +1,356 @@
+package transpiler
+
+import (
+	"context"
+	"fmt"
+	"github.com/olekukonko/tablewriter"
+	"go/ast"
+	"strconv"
+	"strings"
+)
+
+const PreambleSegment = `Preamble`
+const MainSegment = `Main`
+
+// FunctionSegmentPrefix is prepended to function names so that they never collide with
+// the Preamble and Main segments.
+const FunctionSegmentPrefix = `func:`
+
+// Segment is a contiguous block of instructions in the output program.
+// Start is inclusive and End is exclusive.
+type Segment struct {
+	Name        string
+	Start       int
+	End         int
+	Statements  []MLOGStatement
+	Function    *Function
+	Declaration *ast.FuncDecl
+
+	fragment bool
+}
+
+// Program is a transpiled program split into its Preamble, Main and function segments.
+//
+// Segments always describe the default layout, Assembled describes the layout produced by
+// the last successful AssembleSegments call. Statements are shared between both, so only
+// Start and End of Assembled reflect the assembled layout.
+type Program struct {
+	Segments  []*Segment
+	Assembled []*Segment
+
+	ctx    context.Context
+	global *Global
+	input  string
+}
+
+// Render outputs the program in its default layout.
+func (p *Program) Render() string {
+	return p.render(p.Segments)
+}
+
+// AssembleSegments lays out the segments in the provided order, interleaved with the
+// provided hand-written fragments, and re-resolves all jump targets for the new layout.
+//
+// Every generated segment must be present exactly once and the Preamble must come first.
+// If Main is not the last segment, an end instruction is added after it to retain the
+// wrap-around to the start of the program.
+//
+// Without a Preamble, the first segment must be Main or a fragment.
+//
+// Numeric jump targets of plain MLOG statements within a fragment are relative to the
+// first instruction of the fragment and may not leave it, nor may they write @counter.
+// Other statements, such as MLOGJump, resolve their own targets.
+func (p *Program) AssembleSegments(order []string, extra map[string][]MLOGStatement) (string, error) {
+	for name := range extra {
+		if name == PreambleSegment || name == MainSegment || strings.HasPrefix(name, FunctionSegmentPrefix) {
+			return "", Err(p.ctx, "reserved fragment name: "+name)
+		}
+	}
+
+	available := make(map[string]*Segment)
+	for _, segment := range p.Segments {
+		available[segment.Name] = segment
+	}
+
+	mainSegment := available[MainSegment]
+
+	called := make(map[*Function]bool)
+	for _, fn := range p.global.Functions {
+		called[fn] = fn.Called
+	}
+
+	defer func() {
+		for fn, wasCalled := range called {
+			fn.Called = wasCalled
+		}
+	}()
+
+	used := make(map[string]bool)
+	segments := make([]*Segment, 0, len(order))
+	for i, name := range order {
+		if used[name] {
+			return "", Err(p.ctx, "segment used more than once: "+name)
+		}
+		used[name] = true
+
+		segment, isSegment := available[name]
+		fragment, isFragment := extra[name]
+
+		if isSegment {
+			statements := segment.Statements
+			if name == MainSegment && i < len(order)-1 {
+				statements = append(append([]MLOGStatement{}, statements...), &MLOG{
+					Comment: "End of main",
+					Statement: [][]Resolvable{
+						{
+							&Value{Value: "end"},
+						},
+					},
+				})
+			}
+
+			segments = append(segments, &Segment{
+				Name:        segment.Name,
+				Statements:  statements,
+				Function:    segment.Function,
+				Declaration: segment.Declaration,
+			})
+			continue
+		}
+
+		if !isFragment {
+			return "", Err(p.ctx, "unknown segment: "+name)
+		}
+
+		fragmentSegment := &Segment{
+			Name:        name,
+			Statements:  make([]MLOGStatement, len(fragment)),
+			Function:    mainSegment.Function,
+			Declaration: mainSegment.Declaration,
+			fragment:    true,
+		}
+
+		fragmentCtx := context.WithValue(p.ctx, contextFunction, mainSegment.Declaration)
+		for j, statement := range fragment {
+			if err := statement.PreProcess(fragmentCtx, p.global, mainSegment.Function); err != nil {
+				return "", err
+			}
+
+			if mlog, ok := statement.(*MLOG); ok {
+				statement = &fragmentStatement{
+					MLOG:    mlog,
+					segment: fragmentSegment,
+				}
+			}
+
+			fragmentSegment.Statements[j] = statement
+		}
+
+		segments = append(segments, fragmentSegment)
+	}
+
+	// Fragments may jump to functions that were tree-shaken from the generated program
+	for _, fn := range p.global.Functions {
+		if fn.Called && !called[fn] {
+			return "", Err(p.ctx, "fragment calls function that is not part of the program: "+fn.Name)
+		}
+	}
+
+	for _, segment := range p.Segments {
+		if !used[segment.Name] {
+			return "", Err(p.ctx, "missing segment: "+segment.Name)
+		}
+	}
+
+	for name := range extra {
+		if !used[name] {
+			return "", Err(p.ctx, "unused fragment: "+name)
+		}
+	}
+
+	if _, ok := available[PreambleSegment]; ok {
+		if segments[0].Name != PreambleSegment {
+			return "", Err(p.ctx, "preamble must be the first segment")
+		}
+	} else if !segments[0].fragment && segments[0].Name != MainSegment {
+		return "", Err(p.ctx, "function may not be the first segment: "+segments[0].Name)
+	}
+
+	result, err := p.assemble(segments)
+
+	// Restore the default layout
+	if err := p.layout(p.Segments); err != nil {
+		return "", err
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	p.Assembled = segments
+
+	return result, nil
+}
+
+func (p *Program) assemble(segments []*Segment) (string, error) {
+	if err := p.layout(segments); err != nil {
+		return "", err
+	}
+
+	if err := p.validate(segments); err != nil {
+		return "", err
+	}
+
+	return p.render(segments), nil
+}
+
+func (p *Program) layout(segments []*Segment) error {
+	position := 0
+	for _, segment := range segments {
+		segment.Start = position
+		for _, statement := range segment.Statements {
+			position += statement.SetPosition(position)
+		}
+		segment.End = position
+	}
+
+	for _, segment := range segments {
+		segmentCtx := context.WithValue(p.ctx, contextFunction, segment.Declaration)
+		for _, statement := range segment.Statements {
+			if err := statement.PostProcess(segmentCtx, p.global, segment.Function); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Program) validate(segments []*Segment) error {
+	size := segments[len(segments)-1].End
+	for _, segment := range segments {
+		for _, statement := range segment.Statements {
+			_, isFragment := statement.(*fragmentStatement)
+
+			// Generated code may jump to the end of the program, fragments must stay within themselves
+			minTarget, maxTarget := 0, size
+			if isFragment {
+				minTarget, maxTarget = segment.Start, segment.End-1
+			}
+
+			for _, line := range statement.ToMLOG() {
+				if isFragment && writesCounter(line) {
+					return Err(p.ctx, "fragment writes @counter directly in segment: "+segment.Name)
+				}
+
+				if len(line) < 2 || line[0].GetValue() != "jump" {
+					continue
+				}
+
+				target, err := strconv.Atoi(line[1].GetValue())
+				if err != nil || target < minTarget || target > maxTarget {
+					return Err(p.ctx, fmt.Sprintf("invalid jump target in segment %s: %s", segment.Name, line[1].GetValue()))
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func writesCounter(line []Resolvable) bool {
+	if len(line) < 2 {
+		return false
+	}
+
+	switch line[0].GetValue() {
+	case "set", "read":
+		return line[1].GetValue() == "@counter"
+	case "op":
+		return len(line) > 2 && line[2].GetValue() == "@counter"
+	}
+
+	return false
+}
+
+// fragmentStatement rebases fragment relative jump targets onto the position of the fragment
+type fragmentStatement struct {
+	*MLOG
+	segment *Segment
+}
+
+func (m *fragmentStatement) ToMLOG() [][]Resolvable {
+	results := make([][]Resolvable, 0)
+	for _, line := range m.MLOG.ToMLOG() {
+		if len(line) >= 2 && line[0].GetValue() == "jump" {
+			if target, err := strconv.Atoi(line[1].GetValue()); err == nil {
+				line = append([]Resolvable{
+					line[0],
+					&Value{Value: strconv.Itoa(m.segment.Start + target)},
+				}, line[2:]...)
+			}
+		}
+		results = append(results, line)
+	}
+	return results
+}
+
+func (m *fragmentStatement) SetPosition(position int) int {
+	m.MLOG.SetPosition(position)
+	return m.Size()
+}
+
+func (p *Program) render(segments []*Segment) string {
+	options := p.ctx.Value(contextOptions).(Options)
+
+	var tableString *strings.Builder
+	var table *tablewriter.Table
+	if options.Comments || options.Numbers || options.Source {
+		tableString = &strings.Builder{}
+		table = tablewriter.NewWriter(tableString)
+		table.SetBorder(false)
+		table.SetAutoWrapText(false)
+		table.SetCenterSeparator("#")
+		table.SetColumnSeparator("#")
+		table.SetHeaderLine(false)
+		table.SetAlignment(tablewriter.ALIGN_LEFT)
+		table.SetNoWhiteSpace(true)
+		table.SetTablePadding("\t")
+	}
+
+	outputData := ""
+
+	lineNumber := 0
+	for _, segment := range segments {
+		if options.Comments && table != nil && segment.Name != PreambleSegment {
+			table.Append([]string{"#"})
+			if segment.fragment {
+				table.Append([]string{"# Fragment: " + segment.Name + " #"})
+			} else {
+				table.Append([]string{"# Function: " + segment.Function.Name + " #"})
+			}
+			table.Append([]string{"#"})
+		}
+
+		segmentCtx := context.WithValue(p.ctx, contextFunction, segment.Declaration)
+		for _, statement := range segment.Statements {
+			statements := statement.ToMLOG()
+			mlogLines := MLOGToString(segmentCtx, statements, statement, lineNumber, p.input)
+			if table != nil {
+				table.AppendBulk(mlogLines)
+			} else {
+				for _, line := range mlogLines {
+					outputData += line[0] + "\n"
+				}
+			}
+			lineNumber += len(statements)
+		}
+	}
+
+	if table != nil && tableString != nil {
+		table.Render()
+		return tableString.String()
+	}
+
+	return outputData
+}